@@ -0,0 +1,35 @@
+package config
+
+// Config is the worker's top-level configuration, loaded from the
+// cluster's config.json.
+type Config struct {
+	Cluster_name      string `json:"cluster_name"`
+	Import_cache_size int    `json:"import_cache_size"`
+
+	// Pool_size is the number of pre-warmed, /init-executed sandboxes
+	// the import-cache's SandboxPool keeps on hand.
+	Pool_size int `json:"pool_size"`
+	// Pool_warmup_concurrency is how many goroutines concurrently warm
+	// new sandboxes to refill the pool.
+	Pool_warmup_concurrency int `json:"pool_warmup_concurrency"`
+	// Pool_max_idle_ms is how long a warm sandbox can sit unused in the
+	// pool before it's killed and replaced.
+	Pool_max_idle_ms int `json:"pool_max_idle_ms"`
+
+	// Sandbox_backend selects how lambda sandboxes are implemented:
+	// "docker", "olcontainer", or "runsc" (gVisor).
+	Sandbox_backend string `json:"sandbox_backend"`
+	// Runsc_bundle_dir is where the runsc backend keeps each sandbox's
+	// OCI bundle. Only used when Sandbox_backend is "runsc".
+	Runsc_bundle_dir string `json:"runsc_bundle_dir"`
+	// Runsc_rootfs_dir is a pre-built rootfs template (containing /init
+	// and the lambda Python environment) that the runsc backend copies
+	// into each sandbox's bundle. Only used when Sandbox_backend is
+	// "runsc".
+	Runsc_rootfs_dir string `json:"runsc_rootfs_dir"`
+
+	// Checkpoint_dir is where the import-cache's ForkServer tree is
+	// checkpointed on shutdown and restored from on startup. Empty
+	// disables checkpoint/restore entirely.
+	Checkpoint_dir string `json:"checkpoint_dir"`
+}
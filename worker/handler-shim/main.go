@@ -0,0 +1,285 @@
+// handler-shim is a small long-lived process that owns a single lambda
+// container's lifecycle (pause/unpause/kill/restart), independently of the
+// worker daemon.  One shim is launched per handler; if the worker crashes
+// or restarts, the shim and its container keep running, and the worker
+// re-attaches to it on startup by dialing the shim's unix socket and
+// calling Inspect.  This mirrors how a containerd shim v2 process outlives
+// its daemon.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"sync"
+
+	state "github.com/tylerharter/open-lambda/worker/handler_state"
+)
+
+// Shim is the RPC service exposed on the unix socket.  It serializes all
+// docker operations for a single container behind mutex, the same way
+// Handler used to.
+type Shim struct {
+	mutex   sync.Mutex
+	name    string
+	image   string
+	state   state.HandlerState
+	runners int
+}
+
+type RunStartReply struct {
+	Port    string
+	WasIdle bool
+}
+
+type RunFinishReply struct {
+	WentIdle bool
+}
+
+type InspectReply struct {
+	State   state.HandlerState
+	Runners int
+}
+
+func (s *Shim) RunStart(args struct{}, reply *RunStartReply) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.maybeInit(); err != nil {
+		return err
+	}
+
+	if s.runners == 0 {
+		reply.WasIdle = true
+		switch s.state {
+		case state.Stopped:
+			if err := dockerRestart(s.name); err != nil {
+				return err
+			}
+		case state.Paused:
+			if err := dockerUnpause(s.name); err != nil {
+				return err
+			}
+		}
+		s.state = state.Running
+	}
+
+	s.runners++
+
+	port, err := getLambdaPort(s.name)
+	if err != nil {
+		return err
+	}
+	reply.Port = port
+
+	return nil
+}
+
+func (s *Shim) RunFinish(args struct{}, reply *RunFinishReply) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.runners--
+
+	if s.runners == 0 {
+		if err := dockerPause(s.name); err != nil {
+			// TODO(tyler): better way to handle this?  If
+			// we can't pause, the handler gets to keep
+			// running for free...
+			log.Printf("Could not pause %v!  Error: %v\n", s.name, err)
+		}
+		s.state = state.Paused
+		reply.WentIdle = true
+	}
+
+	return nil
+}
+
+func (s *Shim) Stop(args struct{}, reply *struct{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != state.Paused {
+		return nil
+	}
+
+	// TODO(tyler): why do we need to unpause in order to kill?
+	if err := dockerUnpause(s.name); err != nil {
+		log.Printf("Could not unpause %v to kill it!  Error: %v\n", s.name, err)
+	} else if err := dockerKill(s.name); err != nil {
+		// TODO: a resource leak?
+		log.Printf("Could not kill %v after unpausing!  Error: %v\n", s.name, err)
+	} else {
+		s.state = state.Stopped
+	}
+
+	return nil
+}
+
+func (s *Shim) Inspect(args struct{}, reply *InspectReply) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reply.State = s.state
+	reply.Runners = s.runners
+
+	return nil
+}
+
+// maybeInit makes sure the image is pulled and the container exists, and
+// figures out whether it's already running/paused/stopped.  Assumes
+// s.mutex is held.
+func (s *Shim) maybeInit() error {
+	if s.state != state.Unitialized {
+		return nil
+	}
+
+	exists, err := dockerImageExists(s.image)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := dockerPull(s.image); err != nil {
+			return err
+		}
+	}
+
+	exists, err = dockerContainerExists(s.name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := dockerCreate(s.name, s.image); err != nil {
+			return err
+		}
+	}
+
+	running, paused, err := dockerInspectState(s.name)
+	if err != nil {
+		return err
+	}
+
+	if running {
+		if paused {
+			s.state = state.Paused
+		} else {
+			s.state = state.Running
+		}
+	} else {
+		s.state = state.Stopped
+	}
+
+	return nil
+}
+
+func main() {
+	name := flag.String("name", "", "name of the lambda this shim owns")
+	image := flag.String("image", "", "docker image backing this lambda")
+	sockPath := flag.String("sock", "", "unix socket path to serve the shim RPC on")
+	flag.Parse()
+
+	if *name == "" || *sockPath == "" {
+		log.Fatalf("handler-shim requires -name and -sock\n")
+	}
+	if *image == "" {
+		*image = *name
+	}
+
+	os.Remove(*sockPath)
+
+	listener, err := net.Listen("unix", *sockPath)
+	if err != nil {
+		log.Fatalf("could not listen on %s: %v\n", *sockPath, err)
+	}
+	defer listener.Close()
+
+	shim := &Shim{
+		name:  *name,
+		image: *image,
+		state: state.Unitialized,
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Shim", shim); err != nil {
+		log.Fatalf("could not register shim RPC service: %v\n", err)
+	}
+	server.Accept(listener)
+}
+
+func dockerRestart(name string) error {
+	return exec.Command("docker", "restart", name).Run()
+}
+
+func dockerUnpause(name string) error {
+	return exec.Command("docker", "unpause", name).Run()
+}
+
+func dockerPause(name string) error {
+	return exec.Command("docker", "pause", name).Run()
+}
+
+func dockerKill(name string) error {
+	return exec.Command("docker", "kill", name).Run()
+}
+
+func dockerImageExists(image string) (bool, error) {
+	err := exec.Command("docker", "image", "inspect", image).Run()
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	return false, err
+}
+
+func dockerPull(image string) error {
+	return exec.Command("docker", "pull", image).Run()
+}
+
+func dockerContainerExists(name string) (bool, error) {
+	err := exec.Command("docker", "inspect", name).Run()
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	return false, err
+}
+
+func dockerCreate(name, image string) error {
+	return exec.Command("docker", "create", "--name", name, image).Run()
+}
+
+func dockerInspectState(name string) (running bool, paused bool, err error) {
+	out, err := exec.Command("docker", "inspect",
+		"-f", "{{.State.Running}} {{.State.Paused}}", name).Output()
+	if err != nil {
+		return false, false, err
+	}
+
+	fields := string(out)
+	running = len(fields) >= 4 && fields[:4] == "true"
+	paused = len(fields) > 5 && fields[5:9] == "true"
+
+	return running, paused, nil
+}
+
+func getLambdaPort(name string) (string, error) {
+	out, err := exec.Command("docker", "inspect",
+		"-f", "{{(index (index .NetworkSettings.Ports \"8080/tcp\") 0).HostPort}}", name).Output()
+	if err != nil {
+		return "", err
+	}
+
+	port := string(out)
+	for len(port) > 0 && (port[len(port)-1] == '\n' || port[len(port)-1] == '\r') {
+		port = port[:len(port)-1]
+	}
+
+	return port, nil
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"sync"
+	"time"
 
 	state "github.com/tylerharter/open-lambda/worker/handler_state"
 )
 
+// defaultShimStateDir is where handler-shim sockets live when HandlerSetOpts
+// doesn't specify one.  Each lambda gets exactly one <name>.sock here.
+const defaultShimStateDir = "/ol/open-lambda/worker/handler-shims"
+
 type HandlerSetOpts struct {
-	cm  *ContainerManager
-	lru *HandlerLRU
+	cm       *ContainerManager
+	lru      *HandlerLRU
+	stateDir string
 }
 
 type HandlerSet struct {
@@ -17,25 +28,104 @@ type HandlerSet struct {
 	handlers map[string]*Handler
 	cm       *ContainerManager
 	lru      *HandlerLRU
+	stateDir string
 }
 
+// Handler no longer owns any Docker state directly.  Instead it's a thin
+// RPC client for a handler-shim process that owns the container's
+// lifecycle (pause/unpause/kill/restart) independently of the worker, so a
+// worker crash or restart doesn't orphan a leftover container with no
+// owner to clean it up.
 type Handler struct {
-	mutex   sync.Mutex
-	hset    *HandlerSet
-	name    string
-	state   state.HandlerState
-	runners int
+	mutex    sync.Mutex
+	hset     *HandlerSet
+	name     string
+	sockPath string
+	client   *rpc.Client
+}
+
+// RunStartReply is returned by the shim's RunStart RPC.
+type RunStartReply struct {
+	Port    string
+	WasIdle bool
+}
+
+// RunFinishReply is returned by the shim's RunFinish RPC.
+type RunFinishReply struct {
+	WentIdle bool
+}
+
+// InspectReply is returned by the shim's Inspect RPC, and is also how
+// NewHandlerSet rebuilds handler/LRU state after a worker restart.
+type InspectReply struct {
+	State   state.HandlerState
+	Runners int
 }
 
 func NewHandlerSet(opts HandlerSetOpts) (handlerSet *HandlerSet) {
 	if opts.lru == nil {
 		opts.lru = NewHandlerLRU(0)
 	}
+	if opts.stateDir == "" {
+		opts.stateDir = defaultShimStateDir
+	}
+	if err := os.MkdirAll(opts.stateDir, 0700); err != nil {
+		// discoverShims' Glob just comes back empty on a missing dir, but
+		// ensureShim's -sock path needs the directory to actually exist
+		// before handler-shim can net.Listen on it, so fail loudly now
+		// instead of every future RunStart timing out at 5s.
+		log.Fatalf("could not create handler-shim state dir %s: %v\n", opts.stateDir, err)
+	}
 
-	return &HandlerSet{
+	hset := &HandlerSet{
 		handlers: make(map[string]*Handler),
 		cm:       opts.cm,
 		lru:      opts.lru,
+		stateDir: opts.stateDir,
+	}
+
+	hset.discoverShims()
+
+	return hset
+}
+
+// discoverShims finds handler-shim sockets left behind by a previous run of
+// the worker and repopulates handlers/HandlerLRU from whatever state each
+// shim reports, instead of assuming everything starts at state.Unitialized.
+func (h *HandlerSet) discoverShims() {
+	sockPaths, err := filepath.Glob(filepath.Join(h.stateDir, "*.sock"))
+	if err != nil {
+		log.Printf("could not scan %s for handler-shim sockets: %v\n", h.stateDir, err)
+		return
+	}
+
+	for _, sockPath := range sockPaths {
+		name := sockPath[len(h.stateDir)+1 : len(sockPath)-len(".sock")]
+
+		client, err := rpc.Dial("unix", sockPath)
+		if err != nil {
+			log.Printf("handler-shim socket %s is stale (no shim listening), skipping\n", sockPath)
+			continue
+		}
+
+		var reply InspectReply
+		if err := client.Call("Shim.Inspect", struct{}{}, &reply); err != nil {
+			log.Printf("could not inspect handler-shim %s: %v\n", name, err)
+			client.Close()
+			continue
+		}
+
+		handler := &Handler{
+			hset:     h,
+			name:     name,
+			sockPath: sockPath,
+			client:   client,
+		}
+		h.handlers[name] = handler
+
+		if reply.State == state.Paused {
+			h.lru.Add(handler)
+		}
 	}
 }
 
@@ -45,10 +135,9 @@ func (h *HandlerSet) Get(name string) *Handler {
 	handler := h.handlers[name]
 	if handler == nil {
 		handler = &Handler{
-			hset:    h,
-			name:    name,
-			state:   state.Unitialized,
-			runners: 0,
+			hset:     h,
+			name:     name,
+			sockPath: filepath.Join(h.stateDir, name+".sock"),
 		}
 		h.handlers[name] = handler
 	}
@@ -61,54 +150,47 @@ func (h *Handler) RunStart() (port string, err error) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	if err := h.maybeInit(); err != nil {
+	if err := h.ensureShim(); err != nil {
 		return "", err
 	}
 
-	cm := h.hset.cm
-
-	// are we the first?
-	if h.runners == 0 {
-		if h.state == state.Stopped {
-			if err := cm.DockerRestart(h.name); err != nil {
-				return "", err
-			}
-		} else if h.state == state.Paused {
-			if err := cm.DockerUnpause(h.name); err != nil {
-				return "", err
-			}
+	var reply RunStartReply
+	if err := h.client.Call("Shim.RunStart", struct{}{}, &reply); err != nil {
+		// the shim we had a connection to is gone (crashed, killed,
+		// etc); drop it and relaunch one rather than permanently
+		// bricking this handler
+		h.dropShim()
+		if err := h.ensureShim(); err != nil {
+			return "", err
+		}
+		if err := h.client.Call("Shim.RunStart", struct{}{}, &reply); err != nil {
+			h.dropShim()
+			return "", err
 		}
-		h.state = state.Running
-		h.hset.lru.Remove(h)
 	}
 
-	h.runners += 1
-
-	port, err = cm.getLambdaPort(h.name)
-	if err != nil {
-		return "", err
+	if reply.WasIdle {
+		h.hset.lru.Remove(h)
 	}
 
-	return port, nil
+	return reply.Port, nil
 }
 
 func (h *Handler) RunFinish() {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	cm := h.hset.cm
-
-	h.runners -= 1
+	var reply RunFinishReply
+	if err := h.client.Call("Shim.RunFinish", struct{}{}, &reply); err != nil {
+		// the RPC to the shim failed (a failed docker pause is
+		// logged by the shim itself); drop the connection so the
+		// next RunStart redials or relaunches the shim
+		log.Printf("Could not finish run for %v!  Error: %v\n", h.name, err)
+		h.dropShim()
+		return
+	}
 
-	// are we the first?
-	if h.runners == 0 {
-		if err := cm.DockerPause(h.name); err != nil {
-			// TODO(tyler): better way to handle this?  If
-			// we can't pause, the handler gets to keep
-			// running for free...
-			log.Printf("Could not pause %v!  Error: %v\n", h.name, err)
-		}
-		h.state = state.Paused
+	if reply.WentIdle {
 		h.hset.lru.Add(h)
 	}
 }
@@ -117,69 +199,57 @@ func (h *Handler) StopIfPaused() {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	cm := h.hset.cm
-
-	if h.state != state.Paused {
+	if h.client == nil {
 		return
 	}
 
-	// TODO(tyler): why do we need to unpause in order to kill?
-	if err := cm.DockerUnpause(h.name); err != nil {
-		log.Printf("Could not unpause %v to kill it!  Error: %v\n", h.name, err)
-	} else if err := cm.DockerKill(h.name); err != nil {
-		// TODO: a resource leak?
-		log.Printf("Could not kill %v after unpausing!  Error: %v\n", h.name, err)
-	} else {
-		h.state = state.Stopped
+	if err := h.client.Call("Shim.Stop", struct{}{}, &struct{}{}); err != nil {
+		log.Printf("Could not stop %v via its shim!  Error: %v\n", h.name, err)
+		h.dropShim()
 	}
 }
 
-// assume lock held.  Make sure image is pulled, an determine whether
-// container is running.
-func (h *Handler) maybeInit() (err error) {
-	if h.state != state.Unitialized {
-		return nil
+// dropShim closes and forgets this handler's connection to its shim, so
+// the next call to ensureShim redials or relaunches instead of repeating
+// calls against a dead connection forever. Assumes h.mutex is held.
+func (h *Handler) dropShim() {
+	if h.client != nil {
+		h.client.Close()
+		h.client = nil
 	}
+}
 
-	cm := h.hset.cm
-
-	// make sure image is pulled
-	img_exists, err := cm.DockerImageExists(h.name)
-	if err != nil {
-		return err
-	}
-	if !img_exists {
-		if err := cm.DockerPull(h.name); err != nil {
-			return err
-		}
+// ensureShim makes sure a handler-shim is running and reachable for this
+// lambda, launching one if necessary.  Assumes h.mutex is held.
+func (h *Handler) ensureShim() error {
+	if h.client != nil {
+		return nil
 	}
 
-	// make sure container is created
-	cont_exists, err := cm.DockerContainerExists(h.name)
-	if err != nil {
-		return err
-	}
-	if !cont_exists {
-		if _, err := cm.DockerCreate(h.name, []string{}); err != nil {
-			return err
-		}
+	if client, err := rpc.Dial("unix", h.sockPath); err == nil {
+		h.client = client
+		return nil
 	}
 
-	// is container stopped, running, or started?
-	container, err := cm.DockerInspect(h.name)
-	if err != nil {
-		return err
+	cmd := exec.Command("handler-shim",
+		"-name", h.name,
+		"-sock", h.sockPath,
+		"-image", h.name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not launch handler-shim for %v: %v", h.name, err)
 	}
 
-	if container.State.Running {
-		if container.State.Paused {
-			h.state = state.Paused
-		} else {
-			h.state = state.Running
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		client, err := rpc.Dial("unix", h.sockPath)
+		if err == nil {
+			h.client = client
+			return nil
 		}
-	} else {
-		h.state = state.Stopped
+		time.Sleep(50 * time.Millisecond)
 	}
 
-	return nil
-}
\ No newline at end of file
+	return fmt.Errorf("handler-shim for %v did not come up within 5s", h.name)
+}
@@ -27,6 +27,12 @@ type CacheManager struct {
 	mutex   *sync.Mutex
 	sizes   map[string]float64
 	full    *int32
+	evictor *Evictor
+	pool    *SandboxPool
+
+	// checkpointDir is opts.Checkpoint_dir, cached so Cleanup can
+	// checkpoint the tree on shutdown without needing opts again.
+	checkpointDir string
 }
 
 func InitCacheManager(opts *config.Config) (cm *CacheManager, err error) {
@@ -35,20 +41,21 @@ func InitCacheManager(opts *config.Config) (cm *CacheManager, err error) {
 	}
 
 	servers := make([]*ForkServer, 0, 0)
-	sizes, err := readPkgSizes("/ol/open-lambda/worker/cache-manager/package_sizes.txt")
+	sizes, importMs, err := readPkgSizes("/ol/open-lambda/worker/cache-manager/package_sizes.txt")
 	if err != nil {
 		return nil, err
 	}
 
 	var full int32 = 0
 	cm = &CacheManager{
-		cluster: opts.Cluster_name,
-		servers: servers,
-		matcher: NewSubsetMatcher(),
-		seq:     0,
-		mutex:   &sync.Mutex{},
-		sizes:   sizes,
-		full:    &full,
+		cluster:       opts.Cluster_name,
+		servers:       servers,
+		matcher:       NewCostMatcher(importMs, 1.0),
+		seq:           0,
+		mutex:         &sync.Mutex{},
+		sizes:         sizes,
+		full:          &full,
+		checkpointDir: opts.Checkpoint_dir,
 	}
 
 	memCGroupPath, err := cm.initCacheRoot(opts)
@@ -60,6 +67,13 @@ func InitCacheManager(opts *config.Config) (cm *CacheManager, err error) {
 	if err != nil {
 		return nil, err
 	}
+	cm.evictor = e
+
+	if cm.checkpointDir != "" {
+		if err := cm.Restore(cm.checkpointDir); err != nil {
+			log.Printf("no import-cache checkpoint restored from %v: %v\n", cm.checkpointDir, err)
+		}
+	}
 
 	go func(cm *CacheManager) {
 		for {
@@ -139,74 +153,67 @@ func (cm *CacheManager) newCacheEntry(baseFS *ForkServer, toCache []string) (*Fo
 
 	baseFS.Children += 1
 
-	// get container for new entry
-	sandbox, err := cm.factory.Create([]string{"/init"})
+	// get a pre-warmed container for the new entry; /init has already
+	// run and "ready" has already been read, so this doesn't pay
+	// container-boot cost on the critical path
+	sandbox, sockPath, err := cm.pool.Acquire()
 	if err != nil {
 		fs.Kill()
 		return nil, err
 	}
 
-	// open pipe before forkenter
-	pipeDir := filepath.Join(sandbox.HostDir(), "pipe")
-	pipe, err := os.OpenFile(pipeDir, os.O_RDWR, 0777)
-	if err != nil {
-		log.Fatalf("Cannot open pipe: %v\n", err)
-	}
-
-	// signal interpreter to forkenter into sandbox's namespace
+	// signal interpreter to forkenter into sandbox's namespace, and time
+	// it so the matcher can learn the real cost of importing toCache
+	start := time.Now()
 	pid, err := forkRequest(baseFS.SockPath, sandbox.NSPid(), sandbox.RootDir(), toCache, false)
 	if err != nil {
 		fs.Kill()
 		return nil, err
 	}
+	cm.recordImportTime(toCache, time.Since(start))
 
-	sockPath := fmt.Sprintf("%s/fs.sock", sandbox.HostDir())
+	fs.Sandbox = sandbox
+	fs.Pid = pid
+	fs.SockPath = sockPath
 
-	// use StdoutPipe of olcontainer to sync with lambda server
-	ready := make(chan bool, 1)
-	go func() {
-		defer pipe.Close()
+	return fs, nil
+}
 
-		// wait for "ready"
-		buf := make([]byte, 5)
-		n, err := pipe.Read(buf)
+// createFactory picks the CacheFactory for opts.Sandbox_backend. "docker"
+// and "olcontainer" keep going through InitCacheFactory; "runsc" routes to
+// sandbox.NewRunscFactory so a runsc-backed tree's root (and therefore,
+// via cm.factory, every child newCacheEntry later forks) actually comes
+// from the gVisor backend instead of it being dead, unreachable code.
+func (cm *CacheManager) createFactory(opts *config.Config) (factory CacheFactory, rootSB sb.ContainerSandbox, rootDir string, err error) {
+	if opts.Sandbox_backend == "runsc" {
+		rf, err := sb.NewRunscFactory(opts, cm.cluster)
 		if err != nil {
-			log.Fatalf("Cannot read from stdout of olcontainer: %v\n", err)
-		} else if n != 5 {
-			log.Fatalf("Expect to read 5 bytes, only %d read\n", n)
+			return nil, nil, "", err
 		}
-		ready <- true
-	}()
 
-	// wait up to 20s for server to initialize
-	timeout := make(chan bool, 1)
-	go func() {
-		time.Sleep(5 * time.Second)
-		timeout <- true
-	}()
+		root, err := rf.Create([]string{"/init"})
+		if err != nil {
+			return nil, nil, "", err
+		}
 
-	// wait up to 30s for server to initialize
-	start := time.Now()
-	select {
-	case <-ready:
-		log.Printf("wait for server took %v\n", time.Since(start))
-	case <-timeout:
-		return nil, fmt.Errorf("Cache entry failed to initialize after 5s")
+		return rf, root, root.RootDir(), nil
 	}
 
-	fs.Sandbox = sandbox
-	fs.Pid = pid
-	fs.SockPath = sockPath
-
-	return fs, nil
+	return InitCacheFactory(opts, cm.cluster)
 }
 
 func (cm *CacheManager) initCacheRoot(opts *config.Config) (memCGroupPath string, err error) {
-	factory, rootSB, rootDir, err := InitCacheFactory(opts, cm.cluster)
+	// The root sandbox can't come from cm.pool: the pool itself is only
+	// constructible once we have a factory, and the factory doesn't
+	// exist until createFactory returns it below. So only
+	// newCacheEntry (called after this function returns) acquires from
+	// the pool; the root is always a one-off synchronous create.
+	factory, rootSB, rootDir, err := cm.createFactory(opts)
 	if err != nil {
 		return "", err
 	}
 	cm.factory = factory
+	cm.pool = NewSandboxPool(factory, opts)
 
 	// open pipe before forkenter
 	pipeDir := filepath.Join(rootSB.HostDir(), "pipe")
@@ -269,40 +276,66 @@ func (cm *CacheManager) Full() bool {
 	return atomic.LoadInt32(cm.full) == 1
 }
 
-func readPkgSizes(path string) (map[string]float64, error) {
-	sizes := make(map[string]float64)
+// readPkgSizes parses package_sizes.txt.  Each line is either the legacy
+// two-column "name:size" (byte size only, import cost unknown) or the
+// three-column "name:size:import_ms" (adds the package's observed import
+// time in milliseconds, used by CostMatcher).
+func readPkgSizes(path string) (sizes map[string]float64, importMs map[string]float64, err error) {
+	sizes = make(map[string]float64)
+	importMs = make(map[string]float64)
+
 	file, err := os.Open(path)
 	if err != nil {
 		log.Printf("invalid package sizes path %v, using 0 for all", path)
-		return make(map[string]float64), nil
+		return sizes, importMs, nil
 	}
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		if err = scanner.Err(); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		split := strings.Split(scanner.Text(), ":")
-		if len(split) != 2 {
-			return nil, errors.New("malformed package size file")
+		if len(split) != 2 && len(split) != 3 {
+			return nil, nil, errors.New("malformed package size file")
 		}
 
+		name := strings.ToLower(split[0])
+
 		size, err := strconv.Atoi(split[1])
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		sizes[name] = float64(size)
+
+		if len(split) == 3 {
+			ms, err := strconv.Atoi(split[2])
+			if err != nil {
+				return nil, nil, err
+			}
+			importMs[name] = float64(ms)
 		}
-		sizes[strings.ToLower(split[1])] = float64(size)
 	}
 
-	return sizes, nil
+	return sizes, importMs, nil
 }
 
 func (cm *CacheManager) Cleanup() {
+	if cm.checkpointDir != "" {
+		if err := cm.Checkpoint(cm.checkpointDir); err != nil {
+			log.Printf("failed to checkpoint import-cache to %v: %v\n", cm.checkpointDir, err)
+		}
+	}
+
 	for _, server := range cm.servers {
 		server.Kill()
 	}
 
+	if cm.pool != nil {
+		cm.pool.Close()
+	}
+
 	cm.factory.Cleanup()
 }
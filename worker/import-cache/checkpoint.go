@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// checkpointable is implemented by sandboxes whose factory knows how to
+// freeze and dump a running interpreter (e.g. via CRIU).  Backends that
+// don't support it are simply skipped on Checkpoint and rebuilt from
+// scratch on Restore.
+type checkpointable interface {
+	Checkpoint(dumpDir string) error
+	Restore(dumpDir string) error
+}
+
+// backendNamer is implemented by sandboxes that know which backend they
+// came from (e.g. "docker", "runsc"). A checkpoint taken under one
+// backend can't be restored under another, so Restore uses this to fall
+// back to a plain re-fork instead of a native restore when they differ.
+type backendNamer interface {
+	Backend() string
+}
+
+func backendOf(sandbox interface{}) string {
+	if namer, ok := sandbox.(backendNamer); ok {
+		return namer.Backend()
+	}
+	return ""
+}
+
+// cacheNode is the on-disk representation of a single ForkServer in the
+// tree.  ParentIndex is an offset into the manifest's Nodes slice, or -1
+// for the root.
+type cacheNode struct {
+	SockPath    string          `json:"sock_path"`
+	Pid         string          `json:"pid"`
+	Packages    map[string]bool `json:"packages"`
+	Hits        float64         `json:"hits"`
+	ParentIndex int             `json:"parent_index"`
+	Size        float64         `json:"size"`
+	DumpDir     string          `json:"dump_dir"`
+	Backend     string          `json:"backend"`
+}
+
+type cacheManifest struct {
+	Nodes []cacheNode `json:"nodes"`
+}
+
+// Checkpoint freezes every ForkServer in the tree and writes a manifest to
+// path describing how to reconstruct it.  Each node's interpreter is
+// dumped to its own subdirectory of path so Restore can bring it back
+// without re-importing packages that were already warmed.
+func (cm *CacheManager) Checkpoint(path string) error {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+
+	index := make(map[*ForkServer]int, len(cm.servers))
+	for i, fs := range cm.servers {
+		index[fs] = i
+	}
+
+	manifest := cacheManifest{Nodes: make([]cacheNode, len(cm.servers))}
+
+	for i, fs := range cm.servers {
+		fs.Mutex.Lock()
+
+		parentIndex := -1
+		if fs.Parent != nil {
+			parentIndex = index[fs.Parent]
+		}
+
+		node := cacheNode{
+			SockPath:    fs.SockPath,
+			Pid:         fs.Pid,
+			Packages:    fs.Packages,
+			Hits:        fs.Hits,
+			ParentIndex: parentIndex,
+			Size:        fs.Size,
+			DumpDir:     fmt.Sprintf("node-%d", i),
+			Backend:     backendOf(fs.Sandbox),
+		}
+
+		if dumper, ok := fs.Sandbox.(checkpointable); ok {
+			dumpPath := fmt.Sprintf("%s/%s", path, node.DumpDir)
+			if err := os.MkdirAll(dumpPath, 0700); err != nil {
+				fs.Mutex.Unlock()
+				return err
+			}
+			if err := dumper.Checkpoint(dumpPath); err != nil {
+				fs.Mutex.Unlock()
+				return fmt.Errorf("failed to checkpoint %s: %v", fs.SockPath, err)
+			}
+		} else {
+			// no snapshot hook for this backend; Restore will
+			// have to re-fork this node from its parent instead.
+			node.DumpDir = ""
+			log.Printf("sandbox for %s does not support checkpointing, skipping dump\n", fs.SockPath)
+		}
+
+		manifest.Nodes[i] = node
+		fs.Mutex.Unlock()
+	}
+
+	data, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := fmt.Sprintf("%s/manifest.json", path)
+	return os.WriteFile(manifestPath, data, 0600)
+}
+
+// Restore rebuilds the import-cache tree from a manifest written by
+// Checkpoint.  Nodes are restored in manifest order (parents always
+// precede their children), and a node whose parent failed to restore is
+// re-forked from the nearest ancestor that did, re-importing whatever
+// packages were lost along the way.
+func (cm *CacheManager) Restore(path string) error {
+	manifestPath := fmt.Sprintf("%s/manifest.json", path)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	var manifest cacheManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	restored := make([]*ForkServer, len(manifest.Nodes))
+
+	// InitCacheManager already booted a fresh root before Restore ever
+	// runs. If the manifest's node 0 is a root too, reuse that live
+	// bootstrap root instead of standing up a second, disconnected one
+	// (which would leak the bootstrap sandbox and split the tree).
+	start := 0
+	if len(manifest.Nodes) > 0 && manifest.Nodes[0].ParentIndex == -1 &&
+		len(cm.servers) > 0 && cm.servers[0].Parent == nil {
+		root := cm.servers[0]
+		if manifest.Nodes[0].Hits > root.Hits {
+			root.Hits = manifest.Nodes[0].Hits
+		}
+		restored[0] = root
+		start = 1
+	}
+
+	for i := start; i < len(manifest.Nodes); i++ {
+		fs, err := cm.restoreNode(path, manifest.Nodes, i, restored)
+		if err != nil {
+			log.Printf("failed to restore cache node %d (%s): %v\n", i, manifest.Nodes[i].SockPath, err)
+			continue
+		}
+		restored[i] = fs
+		cm.servers = append(cm.servers, fs)
+		cm.seq++
+		if cm.evictor != nil {
+			cm.evictor.Register(fs)
+		}
+	}
+
+	return nil
+}
+
+// restoreNode reconstructs a single node, falling back to a re-fork from
+// the nearest live ancestor when its recorded parent (or any ancestor
+// above it) failed to restore -- it walks all the way up nodes'
+// ParentIndex chain, not just the immediate parent, so a multi-level
+// failure doesn't force an expensive re-fork straight from the root.
+func (cm *CacheManager) restoreNode(path string, nodes []cacheNode, i int, restored []*ForkServer) (*ForkServer, error) {
+	node := nodes[i]
+
+	var parent *ForkServer
+	for ancestor := node.ParentIndex; ancestor >= 0; ancestor = nodes[ancestor].ParentIndex {
+		if restored[ancestor] != nil {
+			parent = restored[ancestor]
+			break
+		}
+	}
+
+	sandbox, err := cm.factory.Create([]string{"/init"})
+	if err != nil {
+		return nil, err
+	}
+
+	size := node.Size
+	if len(cm.sizes) > 0 {
+		size = 0.0
+		for pkg := range node.Packages {
+			size += cm.sizes[pkg]
+		}
+	}
+
+	fs := &ForkServer{
+		Sandbox:  sandbox,
+		Pid:      node.Pid,
+		Packages: node.Packages,
+		Hits:     node.Hits,
+		Parent:   parent,
+		Children: 0,
+		Mutex:    &sync.Mutex{},
+		Size:     size,
+		// matches newCacheEntry/pool.warmOne: every caller that forks
+		// off a node (or serves a direct hit from it) dials SockPath,
+		// so a restored node needs one too even on the native-restore
+		// path, where no forkRequest ever runs to set it.
+		SockPath: fmt.Sprintf("%s/fs.sock", sandbox.HostDir()),
+	}
+
+	sameBackend := node.Backend == backendOf(sandbox)
+	if node.DumpDir != "" && sameBackend {
+		dumpPath := fmt.Sprintf("%s/%s", path, node.DumpDir)
+		if restorer, ok := sandbox.(checkpointable); ok {
+			if err := restorer.Restore(dumpPath); err == nil {
+				if parent != nil {
+					parent.Children++
+				}
+				return fs, nil
+			}
+			log.Printf("checkpoint restore failed for %s, re-forking instead\n", node.SockPath)
+		}
+	} else if node.DumpDir != "" {
+		log.Printf("checkpoint for %s was taken on backend %q, current backend is %q; re-forking instead of restoring\n",
+			node.SockPath, node.Backend, backendOf(sandbox))
+	}
+
+	// either no dump was taken or restoring it failed: fall back to
+	// forking the node back into existence from the nearest ancestor
+	// that did restore (cm.servers[0], the root, if none did), and
+	// re-importing whatever packages that base doesn't already have.
+	base := parent
+	if base == nil {
+		base = cm.servers[0]
+	}
+
+	toImport := make([]string, 0, len(node.Packages))
+	for pkg := range node.Packages {
+		if !base.Packages[pkg] {
+			toImport = append(toImport, pkg)
+		}
+	}
+
+	pid, err := forkRequest(base.SockPath, sandbox.NSPid(), sandbox.RootDir(), toImport, false)
+	if err != nil {
+		fs.Kill()
+		return nil, err
+	}
+
+	fs.Parent = base
+	fs.Pid = pid
+	base.Children++
+
+	return fs, nil
+}
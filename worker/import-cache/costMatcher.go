@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// baseForkMs is the fixed overhead of forking a new interpreter off
+	// an existing ForkServer, independent of its size.
+	baseForkMs = 5.0
+	// sizeCostFactor converts a base's Size (summed package bytes) into
+	// an estimated number of milliseconds added to a fork from it.
+	sizeCostFactor = 0.001
+	// defaultImportMs is used for packages with no observed import cost.
+	defaultImportMs = 100.0
+	// importBlend controls how quickly RecordImportTime's exponential
+	// moving average adapts to newly observed import times.
+	importBlend = 0.2
+)
+
+// CostMatcher picks the ForkServer base that minimizes the predicted cost
+// of serving a request: the cost of forking from that base, plus the cost
+// of importing whatever packages it doesn't already have, minus a bonus
+// for bases that are hot (lots of hits relative to their size). Ties are
+// broken in favor of shallower trees, to bound fork-chain latency.
+type CostMatcher struct {
+	mutex    *sync.Mutex
+	importMs map[string]float64
+	alpha    float64
+}
+
+// NewCostMatcher builds a CostMatcher seeded with per-package import costs
+// (in milliseconds, as parsed from package_sizes.txt) and alpha, the
+// weight given to a base's hit-rate-per-byte when scoring it.
+func NewCostMatcher(importMs map[string]float64, alpha float64) *CostMatcher {
+	if importMs == nil {
+		importMs = make(map[string]float64)
+	}
+
+	return &CostMatcher{
+		mutex:    &sync.Mutex{},
+		importMs: importMs,
+		alpha:    alpha,
+	}
+}
+
+// Match implements CacheMatcher.
+func (cm *CostMatcher) Match(servers []*ForkServer, pkgs []string) (fs *ForkServer, toCache []string, hit bool) {
+	if len(servers) == 0 {
+		return nil, pkgs, false
+	}
+
+	root := servers[0]
+	rootCost := cm.cost(root, pkgs)
+	rootBackend := backendOf(root.Sandbox)
+
+	var best *ForkServer
+	bestCost := 0.0
+	bestDepth := 0
+
+	for _, candidate := range servers {
+		if !isSubset(candidate.Packages, pkgs) {
+			continue
+		}
+
+		// never fork a child from a base running under a different
+		// sandbox backend than the root it belongs to (e.g. a
+		// runsc-backed tree may only grow runsc-backed children)
+		if backendOf(candidate.Sandbox) != rootBackend {
+			continue
+		}
+
+		cost := cm.cost(candidate, pkgs)
+		depth := treeDepth(candidate)
+
+		if best == nil || cost < bestCost || (cost == bestCost && depth < bestDepth) {
+			best = candidate
+			bestCost = cost
+			bestDepth = depth
+		}
+	}
+
+	if best == nil {
+		best = root
+	}
+
+	// don't grow a deep fork chain if forking fresh from the root would
+	// have been just as cheap or cheaper
+	if best != root && bestCost > rootCost {
+		best = root
+	}
+
+	missing := make([]string, 0, len(pkgs))
+	for _, p := range pkgs {
+		if !best.Packages[p] {
+			missing = append(missing, p)
+		}
+	}
+
+	return best, missing, len(missing) == 0
+}
+
+// cost predicts the time, in milliseconds, of serving pkgs by forking from
+// base and importing whatever packages base doesn't already have.
+func (cm *CostMatcher) cost(base *ForkServer, pkgs []string) float64 {
+	total := baseForkMs + base.Size*sizeCostFactor
+
+	for _, p := range pkgs {
+		if base.Packages[p] {
+			continue
+		}
+		total += cm.importCost(p)
+	}
+
+	size := base.Size
+	if size <= 0 {
+		size = 1.0
+	}
+	total -= cm.alpha * base.Hits / size
+
+	return total
+}
+
+func (cm *CostMatcher) importCost(pkg string) float64 {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if ms, ok := cm.importMs[pkg]; ok {
+		return ms
+	}
+	return defaultImportMs
+}
+
+// RecordImportTime blends an observed import time for pkg into the cost
+// table via an exponential moving average, so the matcher self-tunes as
+// real traffic is served.
+func (cm *CostMatcher) RecordImportTime(pkg string, observed time.Duration) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	ms := float64(observed) / float64(time.Millisecond)
+
+	old, ok := cm.importMs[pkg]
+	if !ok {
+		cm.importMs[pkg] = ms
+		return
+	}
+	cm.importMs[pkg] = importBlend*ms + (1-importBlend)*old
+}
+
+func isSubset(base map[string]bool, pkgs []string) bool {
+	for key := range base {
+		found := false
+		for _, p := range pkgs {
+			if p == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func treeDepth(fs *ForkServer) int {
+	depth := 0
+	for fs.Parent != nil {
+		depth++
+		fs = fs.Parent
+	}
+	return depth
+}
+
+// importRecorder is implemented by matchers that want to learn from
+// observed import times (currently just CostMatcher). recordImportTime is
+// a no-op against matchers that don't.
+type importRecorder interface {
+	RecordImportTime(pkg string, observed time.Duration)
+}
+
+// recordImportTime divides the observed wall-clock cost of importing pkgs
+// evenly across them and feeds each back into the matcher, if it supports
+// online cost updates.
+func (cm *CacheManager) recordImportTime(pkgs []string, observed time.Duration) {
+	recorder, ok := cm.matcher.(importRecorder)
+	if !ok || len(pkgs) == 0 {
+		return
+	}
+
+	perPkg := observed / time.Duration(len(pkgs))
+	for _, p := range pkgs {
+		recorder.RecordImportTime(strings.ToLower(p), perPkg)
+	}
+}
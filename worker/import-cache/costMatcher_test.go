@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func newTestFS(parent *ForkServer, size, hits float64, pkgs ...string) *ForkServer {
+	packages := make(map[string]bool, len(pkgs))
+	for _, p := range pkgs {
+		packages[p] = true
+	}
+	return &ForkServer{
+		Packages: packages,
+		Hits:     hits,
+		Parent:   parent,
+		Mutex:    &sync.Mutex{},
+		Size:     size,
+	}
+}
+
+func TestCostMatcherPrefersCheaperBase(t *testing.T) {
+	matcher := NewCostMatcher(map[string]float64{"numpy": 10, "pandas": 200}, 1.0)
+
+	root := newTestFS(nil, 1.0, 0)
+	cheap := newTestFS(root, 100, 0, "numpy")
+	expensive := newTestFS(root, 100000, 0, "numpy")
+
+	servers := []*ForkServer{root, cheap, expensive}
+
+	fs, toCache, hit := matcher.Match(servers, []string{"numpy", "pandas"})
+	if fs != cheap {
+		t.Fatalf("expected cheap base to win, got %+v", fs)
+	}
+	if hit {
+		t.Fatalf("expected a miss since pandas must be imported")
+	}
+	if len(toCache) != 1 || toCache[0] != "pandas" {
+		t.Fatalf("expected toCache=[pandas], got %v", toCache)
+	}
+}
+
+func TestCostMatcherExactMatchIsHit(t *testing.T) {
+	matcher := NewCostMatcher(nil, 1.0)
+
+	root := newTestFS(nil, 1.0, 0)
+	withNumpy := newTestFS(root, 100, 5, "numpy")
+
+	_, toCache, hit := matcher.Match([]*ForkServer{root, withNumpy}, []string{"numpy"})
+	if !hit {
+		t.Fatalf("expected a hit when requested packages are already cached")
+	}
+	if len(toCache) != 0 {
+		t.Fatalf("expected no packages left to cache, got %v", toCache)
+	}
+}
+
+func TestCostMatcherPrefersShallowerOnTie(t *testing.T) {
+	matcher := NewCostMatcher(nil, 0)
+
+	root := newTestFS(nil, 1.0, 0)
+	shallow := newTestFS(root, 100, 0, "numpy")
+	deep := newTestFS(shallow, 100, 0, "numpy")
+
+	fs, _, _ := matcher.Match([]*ForkServer{root, shallow, deep}, []string{"numpy"})
+	if fs != shallow {
+		t.Fatalf("expected the shallower of two equal-cost bases to win, got %+v", fs)
+	}
+}
+
+func TestCostMatcherRefusesExpensiveChild(t *testing.T) {
+	matcher := NewCostMatcher(map[string]float64{"huge": 1000000}, 1.0)
+
+	root := newTestFS(nil, 1.0, 0)
+	child := newTestFS(root, 100, 0)
+
+	fs, _, _ := matcher.Match([]*ForkServer{root, child}, []string{"huge"})
+	if fs != root {
+		t.Fatalf("expected to fork straight from root when forking from child isn't cheaper, got %+v", fs)
+	}
+}
+
+func TestCostMatcherRecordImportTimeBlends(t *testing.T) {
+	matcher := NewCostMatcher(map[string]float64{"numpy": 100}, 1.0)
+
+	matcher.RecordImportTime("numpy", 200_000_000) // 200ms
+	got := matcher.importCost("numpy")
+	if got <= 100 || got >= 200 {
+		t.Fatalf("expected blended cost strictly between old and new observation, got %v", got)
+	}
+}
+
+func TestReadPkgSizesLegacyAndExtendedSchema(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "package_sizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.WriteString("numpy:1000\n")
+	f.WriteString("pandas:5000:150\n")
+
+	sizes, importMs, err := readPkgSizes(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if sizes["numpy"] != 1000 {
+		t.Errorf("expected numpy size 1000, got %v", sizes["numpy"])
+	}
+	if _, ok := importMs["numpy"]; ok {
+		t.Errorf("legacy two-column line should not set an import cost")
+	}
+	if sizes["pandas"] != 5000 {
+		t.Errorf("expected pandas size 5000, got %v", sizes["pandas"])
+	}
+	if importMs["pandas"] != 150 {
+		t.Errorf("expected pandas import cost 150, got %v", importMs["pandas"])
+	}
+}
+
+func TestReadPkgSizesMalformedLine(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "package_sizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	f.WriteString("not-a-valid-line\n")
+
+	if _, _, err := readPkgSizes(f.Name()); err == nil {
+		t.Fatalf("expected an error for a malformed package size line")
+	}
+}
+
+func TestReadPkgSizesMissingFile(t *testing.T) {
+	sizes, importMs, err := readPkgSizes("/no/such/path/package_sizes.txt")
+	if err != nil {
+		t.Fatalf("missing file should fall back to empty maps, got error: %v", err)
+	}
+	if len(sizes) != 0 || len(importMs) != 0 {
+		t.Fatalf("expected empty maps for a missing file, got %v %v", sizes, importMs)
+	}
+}
@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	sb "github.com/open-lambda/open-lambda/worker/sandbox"
+
+	"github.com/open-lambda/open-lambda/worker/config"
+)
+
+// warmSandbox is a sandbox that has already run /init and had its "ready"
+// byte read off the pipe, so it can be handed to a fork request without
+// paying container-boot latency on the critical path.
+type warmSandbox struct {
+	sandbox  sb.ContainerSandbox
+	sockPath string
+	bornAt   time.Time
+}
+
+// SandboxPool keeps a target number of warm, /init-executed sandboxes on
+// hand so cache misses don't have to wait on factory.Create.  Background
+// goroutines refill the pool as sandboxes are borrowed or age out.
+//
+// ready holds the actual warm sandboxes, guarded by mutex, rather than a
+// channel: reapLoop needs to peek at a sandbox's age and decide whether to
+// evict it without ever fully handing it off, which a channel can't do
+// without first popping it -- and by the time it tries to push a
+// non-expired sandbox back, a concurrent fillLoop may have already filled
+// the freed slot, non-blocking-re-sending into `default` and killing a
+// perfectly healthy sandbox instead.
+type SandboxPool struct {
+	factory CacheFactory
+	target  int
+	maxIdle time.Duration
+	mutex   *sync.Mutex
+	ready   []*warmSandbox
+	done    chan struct{}
+}
+
+// NewSandboxPool starts a pool of warm sandboxes sized and configured from
+// opts, and kicks off opts.Pool_warmup_concurrency background fill
+// goroutines (at least one) and one reap goroutine.
+func NewSandboxPool(factory CacheFactory, opts *config.Config) *SandboxPool {
+	target := opts.Pool_size
+	if target <= 0 {
+		target = 1
+	}
+
+	maxIdle := time.Duration(opts.Pool_max_idle_ms) * time.Millisecond
+	if maxIdle <= 0 {
+		maxIdle = 5 * time.Minute
+	}
+
+	pool := &SandboxPool{
+		factory: factory,
+		target:  target,
+		maxIdle: maxIdle,
+		mutex:   &sync.Mutex{},
+		done:    make(chan struct{}),
+	}
+
+	concurrency := opts.Pool_warmup_concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	for i := 0; i < concurrency; i++ {
+		go pool.fillLoop()
+	}
+	go pool.reapLoop()
+
+	return pool
+}
+
+// atCapacity reports whether the pool already holds target sandboxes.
+func (p *SandboxPool) atCapacity() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.ready) >= p.target
+}
+
+// fillLoop keeps warming sandboxes and appending them to ready until the
+// pool is at its target size.
+func (p *SandboxPool) fillLoop() {
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		if p.atCapacity() {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+
+		ws, err := p.warmOne()
+		if err != nil {
+			log.Printf("failed to warm pool sandbox: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		p.mutex.Lock()
+		if len(p.ready) >= p.target {
+			// a concurrent fillLoop filled the last slot first
+			p.mutex.Unlock()
+			ws.sandbox.Kill()
+			continue
+		}
+		p.ready = append(p.ready, ws)
+		p.mutex.Unlock()
+	}
+}
+
+// reapLoop kills and replaces ready sandboxes that have been sitting idle
+// longer than maxIdle, so they don't count against the import-cache
+// cgroup budget the Evictor is tracking.  It scans and removes expired
+// entries under p.mutex in one step, so there's no window for a
+// concurrent fillLoop or Acquire to race it.
+func (p *SandboxPool) reapLoop() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-time.After(time.Second):
+		}
+
+		var expired []*warmSandbox
+		p.mutex.Lock()
+		kept := p.ready[:0]
+		for _, ws := range p.ready {
+			if time.Since(ws.bornAt) >= p.maxIdle {
+				expired = append(expired, ws)
+			} else {
+				kept = append(kept, ws)
+			}
+		}
+		p.ready = kept
+		p.mutex.Unlock()
+
+		for _, ws := range expired {
+			ws.sandbox.Kill()
+		}
+	}
+}
+
+// warmOne creates a new sandbox, runs /init, and blocks until the
+// interpreter reports "ready" on its pipe.
+func (p *SandboxPool) warmOne() (*warmSandbox, error) {
+	sandbox, err := p.factory.Create([]string{"/init"})
+	if err != nil {
+		return nil, err
+	}
+
+	pipeDir := filepath.Join(sandbox.HostDir(), "pipe")
+	pipe, err := os.OpenFile(pipeDir, os.O_RDWR, 0777)
+	if err != nil {
+		sandbox.Kill()
+		return nil, fmt.Errorf("cannot open pipe: %v", err)
+	}
+
+	ready := make(chan bool, 1)
+	go func() {
+		defer pipe.Close()
+		buf := make([]byte, 5)
+		n, err := pipe.Read(buf)
+		if err != nil || n != 5 {
+			return
+		}
+		ready <- true
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		sandbox.Kill()
+		return nil, fmt.Errorf("pool sandbox failed to initialize after 5s")
+	}
+
+	return &warmSandbox{
+		sandbox:  sandbox,
+		sockPath: fmt.Sprintf("%s/fs.sock", sandbox.HostDir()),
+		bornAt:   time.Now(),
+	}, nil
+}
+
+// Acquire takes a warm sandbox from the pool, blocking up to 5s for one to
+// become available before falling back to a synchronous factory.Create.
+func (p *SandboxPool) Acquire() (sb.ContainerSandbox, string, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mutex.Lock()
+		if len(p.ready) > 0 {
+			ws := p.ready[len(p.ready)-1]
+			p.ready = p.ready[:len(p.ready)-1]
+			p.mutex.Unlock()
+			return ws.sandbox, ws.sockPath, nil
+		}
+		p.mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	log.Printf("sandbox pool empty, falling back to synchronous create\n")
+	ws, err := p.warmOne()
+	if err != nil {
+		return nil, "", err
+	}
+	return ws.sandbox, ws.sockPath, nil
+}
+
+// Close stops the fill and reap goroutines and kills any sandboxes still
+// sitting in the pool.
+func (p *SandboxPool) Close() {
+	close(p.done)
+
+	p.mutex.Lock()
+	leftover := p.ready
+	p.ready = nil
+	p.mutex.Unlock()
+
+	for _, ws := range leftover {
+		ws.sandbox.Kill()
+	}
+}
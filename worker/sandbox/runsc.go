@@ -0,0 +1,280 @@
+// Package sandbox provides the pluggable backends that create and manage
+// the containers a ContainerSandbox represents.  This file adds a runsc
+// (gVisor) backend: docker/olcontainer give lambda code kernel-level
+// trust via forkenter across shared namespaces, which is fine for a
+// trusted tenant but not acceptable for a multi-tenant public deployment.
+// runsc instead runs each sandbox's interpreter inside its own gVisor
+// sentry.
+//
+// The fork-server protocol itself (what forkRequest speaks to SockPath)
+// is unchanged: every backend execs the same /init binary, and
+// forkRequest talks to it the same way regardless of backend. What
+// differs under runsc is that /init can't forkenter across a host
+// namespace the way it does under docker/olcontainer, since gVisor
+// sentries don't expose one; /init is expected to clone a new
+// sentry-local process instead when it detects it's running under runsc.
+// That fork-implementation detail lives in /init itself, not in this Go
+// package, so there's no separate agent or wire format here to maintain --
+// but /init still needs its usual rootfs (with /init itself present) and
+// a way to reach HostDir() for the pipe/socket handshake, both of which
+// Create sets up below: rootDir is seeded by copying Runsc_rootfs_dir,
+// and hostDir is bind-mounted into the sentry at inContainerHostDir.
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/open-lambda/open-lambda/worker/config"
+)
+
+// inContainerHostDir is where a runsc sandbox's HostDir() is bind-mounted
+// inside the sentry. /init looks here (via the OL_HOST_DIR env var set in
+// the OCI spec below) for the same pipe and fs.sock that the host process
+// opens at HostDir() directly.
+const inContainerHostDir = "/host"
+
+// RunscSandbox is a ContainerSandbox backed by a runsc (gVisor) sentry
+// running an OCI bundle, rather than a shared-namespace docker container.
+type RunscSandbox struct {
+	id      string
+	bundle  string
+	rootDir string
+	hostDir string
+	cgroup  string
+	nsPid   string
+}
+
+// NSPid returns the pid of the sentry's init process as seen from the
+// host pid namespace (passed to forkRequest as the target of a fork
+// request, even though runsc sandboxes don't support host-namespace
+// forkenter).
+func (s *RunscSandbox) NSPid() string {
+	return s.nsPid
+}
+
+// RootDir returns the path of the sandbox's rootfs as mounted on the
+// host, for factories that need to drop files into it before start.
+func (s *RunscSandbox) RootDir() string {
+	return s.rootDir
+}
+
+// HostDir returns the sandbox's scratch directory on the host (pipe,
+// sockets, logs), mirroring the olcontainer/docker backends.
+func (s *RunscSandbox) HostDir() string {
+	return s.hostDir
+}
+
+// CGroupEnter moves pid into this sandbox's cgroup.
+func (s *RunscSandbox) CGroupEnter(pid string) error {
+	procsPath := filepath.Join(s.cgroup, "cgroup.procs")
+	f, err := os.OpenFile(procsPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", procsPath, err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(pid); err != nil {
+		return fmt.Errorf("could not add pid %s to cgroup %s: %v", pid, s.cgroup, err)
+	}
+
+	return nil
+}
+
+// MemoryCGroupPath returns the path to this sandbox's memory cgroup, used
+// by the Evictor to track the import-cache's memory budget.
+func (s *RunscSandbox) MemoryCGroupPath() string {
+	return s.cgroup
+}
+
+// Kill sends SIGKILL to the sentry. It does not run "runsc delete", so the
+// container's runsc state and its bundle directory are left in place.
+func (s *RunscSandbox) Kill() error {
+	return exec.Command("runsc", "kill", s.id, "SIGKILL").Run()
+}
+
+// Checkpoint dumps the sentry's state via runsc's native checkpoint
+// support, satisfying the cache package's checkpointable interface.
+func (s *RunscSandbox) Checkpoint(dumpDir string) error {
+	return exec.Command("runsc", "checkpoint",
+		"--image-path", dumpDir, s.id).Run()
+}
+
+// Restore restores a previously checkpointed sentry from dumpDir,
+// satisfying the cache package's checkpointable interface.
+func (s *RunscSandbox) Restore(dumpDir string) error {
+	return exec.Command("runsc", "restore",
+		"--image-path", dumpDir,
+		"--bundle", s.bundle, s.id).Run()
+}
+
+// Backend identifies this sandbox's backend, so the cache package can
+// refuse to fork a runsc child off a non-runsc parent (and vice versa).
+func (s *RunscSandbox) Backend() string {
+	return "runsc"
+}
+
+// RunscFactory creates RunscSandboxes.  It implements the cache package's
+// CacheFactory interface structurally (Create/Cleanup), the same way the
+// docker and olcontainer factories do.
+type RunscFactory struct {
+	cluster   string
+	bundleDir string
+	rootfsDir string
+	seq       *int64
+}
+
+// NewRunscFactory builds a RunscFactory rooted at opts.Runsc_bundle_dir,
+// where each sandbox gets its own numbered OCI bundle subdirectory seeded
+// from opts.Runsc_rootfs_dir.
+func NewRunscFactory(opts *config.Config, cluster string) (*RunscFactory, error) {
+	bundleDir := opts.Runsc_bundle_dir
+	if bundleDir == "" {
+		bundleDir = "/ol/open-lambda/worker/runsc-bundles"
+	}
+
+	rootfsDir := opts.Runsc_rootfs_dir
+	if rootfsDir == "" {
+		rootfsDir = "/ol/open-lambda/worker/runsc-rootfs"
+	}
+	if _, err := os.Stat(rootfsDir); err != nil {
+		return nil, fmt.Errorf("runsc rootfs template %s not found: %v", rootfsDir, err)
+	}
+
+	if err := os.MkdirAll(bundleDir, 0700); err != nil {
+		return nil, err
+	}
+
+	var seq int64 = 0
+	return &RunscFactory{
+		cluster:   cluster,
+		bundleDir: bundleDir,
+		rootfsDir: rootfsDir,
+		seq:       &seq,
+	}, nil
+}
+
+// Create starts a new runsc sandbox that execs cmd as its entrypoint
+// (e.g. []string{"/init"} for a fresh fork-server root or leaf). It
+// returns the ContainerSandbox interface, not the concrete *RunscSandbox,
+// so CacheFactory.Create type-checks the same way across every backend
+// (cm.factory.Create is called polymorphically without knowing which
+// backend is in play).
+func (f *RunscFactory) Create(cmd []string) (ContainerSandbox, error) {
+	id := fmt.Sprintf("%s-%d", f.cluster, atomic.AddInt64(f.seq, 1))
+	bundle := filepath.Join(f.bundleDir, id)
+	rootDir := filepath.Join(bundle, "rootfs")
+	hostDir := filepath.Join(bundle, "host")
+	cgroup := filepath.Join("/sys/fs/cgroup/memory", "ol-runsc", id)
+
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cgroup, 0700); err != nil {
+		return nil, err
+	}
+
+	// seed rootDir from the rootfs template so /init (and the rest of the
+	// lambda Python environment) actually exists inside the sentry
+	if out, err := exec.Command("cp", "-a", f.rootfsDir, rootDir).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("could not seed rootfs from %s: %v: %s", f.rootfsDir, err, strings.TrimSpace(string(out)))
+	}
+
+	// pre-create the pipe FIFO on the host side of hostDir; once hostDir
+	// is bind-mounted in below, /init opens the very same inode at
+	// inContainerHostDir/pipe to signal "ready"
+	pipePath := filepath.Join(hostDir, "pipe")
+	if err := syscall.Mkfifo(pipePath, 0666); err != nil {
+		return nil, fmt.Errorf("could not create pipe %s: %v", pipePath, err)
+	}
+
+	if err := writeRunscConfig(bundle, rootDir, hostDir, cmd); err != nil {
+		return nil, err
+	}
+
+	runArgs := []string{"run", "--detach", "--bundle", bundle, id}
+	if out, err := exec.Command("runsc", runArgs...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("runsc run failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	nsPid, err := exec.Command("runsc", "list", "-f", "{{.Pid}}", id).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine runsc sentry pid for %s: %v", id, err)
+	}
+
+	return &RunscSandbox{
+		id:      id,
+		bundle:  bundle,
+		rootDir: rootDir,
+		hostDir: hostDir,
+		cgroup:  cgroup,
+		nsPid:   strings.TrimSpace(string(nsPid)),
+	}, nil
+}
+
+// Cleanup kills every sandbox this factory has started and removes their
+// bundle directories.
+func (f *RunscFactory) Cleanup() error {
+	// each bundle subdirectory is named after the sandbox id it holds
+	if entries, err := os.ReadDir(f.bundleDir); err == nil {
+		for _, entry := range entries {
+			exec.Command("runsc", "kill", entry.Name(), "SIGKILL").Run()
+		}
+	}
+	return os.RemoveAll(f.bundleDir)
+}
+
+// ociMount is a single bind mount entry in an OCI runtime config.json.
+type ociMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// ociSpec is the minimal subset of the OCI runtime spec runsc needs: an
+// entrypoint, a rootfs, and the host-dir bind mount /init relies on to
+// reach the pipe/socket handshake.
+type ociSpec struct {
+	OciVersion string `json:"ociVersion"`
+	Process    struct {
+		Args []string `json:"args"`
+		Cwd  string   `json:"cwd"`
+		Env  []string `json:"env"`
+	} `json:"process"`
+	Root struct {
+		Path string `json:"path"`
+	} `json:"root"`
+	Mounts []ociMount `json:"mounts"`
+}
+
+// writeRunscConfig writes an OCI config.json for cmd into bundle, rooted
+// at rootDir, with hostDir bind-mounted in at inContainerHostDir so /init
+// can reach the pipe and fs.sock the host process opens at HostDir().
+func writeRunscConfig(bundle, rootDir, hostDir string, cmd []string) error {
+	var spec ociSpec
+	spec.OciVersion = "1.0.0"
+	spec.Process.Args = cmd
+	spec.Process.Cwd = "/"
+	spec.Process.Env = []string{"OL_HOST_DIR=" + inContainerHostDir}
+	spec.Root.Path = rootDir
+	spec.Mounts = []ociMount{{
+		Destination: inContainerHostDir,
+		Type:        "bind",
+		Source:      hostDir,
+		Options:     []string{"rbind", "rw"},
+	}}
+
+	data, err := json.MarshalIndent(&spec, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(bundle, "config.json"), data, 0600)
+}